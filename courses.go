@@ -22,12 +22,48 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"sync"
+	"time"
 )
 
 type coursetypeT string
 
+const (
+	sport      coursetypeT = "Sport"
+	enrichment coursetypeT = "Enrichment"
+	culture    coursetypeT = "Culture"
+)
+
+var errUnknownCourseType = errors.New("unknown course type")
+
+/*
+ * Scan implements sql.Scanner so that setupCourses fails loudly on a row
+ * whose ctype column doesn't match one of the known coursetypeT values,
+ * instead of silently storing an unrecognized type that would never be
+ * subject to any per-category quota.
+ */
+func (t *coursetypeT) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into coursetypeT", src)
+	}
+	switch coursetypeT(s) {
+	case sport, enrichment, culture:
+		*t = coursetypeT(s)
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errUnknownCourseType, s)
+	}
+}
+
 type courseT struct {
 	ID           int
 	Selected     int
@@ -39,14 +75,6 @@ type courseT struct {
 	Location     string
 }
 
-/*
- * const (
- * 	sport      coursetypeT = "Sport"
- * 	enrichment coursetypeT = "Enrichment"
- * 	culture    coursetypeT = "Culture"
- * )
- */
-
 /*
  * The courses are simply stored in a map indexed by the course ID, although
  * the course struct itself also contains an ID field. A lock is embedded
@@ -108,7 +136,81 @@ func setupCourses() error {
 		courses[currentCourse.ID] = &currentCourse
 	}
 
-	/* TODO: Populate currentCourse.Selected from the database */
+	counts, err := fetchSelectedCounts(context.Background())
+	if err != nil {
+		return err
+	}
+	for id, course := range courses {
+		course.Selected = counts[id]
+	}
+
+	go reconcileSelectedLoop(context.Background())
 
 	return nil
 }
+
+/*
+ * fetchSelectedCounts aggregates the choices table into a per-course
+ * selection count, as the source of truth that courseT.Selected is
+ * seeded from at setup and periodically reconciled against afterwards.
+ */
+func fetchSelectedCounts(ctx context.Context) (map[int]int, error) {
+	rows, err := db.Query(
+		ctx,
+		"SELECT courseid, COUNT(*) FROM choices GROUP BY courseid",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching course selection counts: %w", err)
+	}
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var courseID, count int
+		err := rows.Scan(&courseID, &count)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching course selection counts: %w", err)
+		}
+		counts[courseID] = count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching course selection counts: %w", err)
+	}
+
+	return counts, nil
+}
+
+/*
+ * reconcileSelectedLoop periodically recomputes each course's Selected
+ * count from the choices table and corrects any drift against the
+ * in-memory counter. Drift can occur today if a transaction commits but
+ * the in-memory increment/decrement in the Y/N handlers panics, or vice
+ * versa.
+ */
+func reconcileSelectedLoop(ctx context.Context) {
+	ticker := time.NewTicker(config.Perf.ReconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		counts, err := fetchSelectedCounts(ctx)
+		if err != nil {
+			log.Printf("error reconciling course selection counts: %v", err)
+			continue
+		}
+
+		coursesLock.RLock()
+		for id, course := range courses {
+			actual := counts[id]
+			course.SelectedLock.Lock()
+			if course.Selected != actual {
+				log.Printf(
+					"WARNING: course %d Selected drifted from database (in-memory %d, database %d); correcting\n",
+					id, course.Selected, actual,
+				)
+				course.Selected = actual
+			}
+			course.SelectedLock.Unlock()
+		}
+		coursesLock.RUnlock()
+	}
+}
@@ -135,14 +135,12 @@ func handleWs(w http.ResponseWriter, req *http.Request) {
 
 	/*
 	 * Now that we have an authenticated request, this WebSocket connection
-	 * may be simply associated with the session and userID.
-	 * TODO: There are various race conditions that could occur if one user
-	 * creates multiple connections, with the same or different session
-	 * cookies. The last situation could occur in normal use when a user
-	 * opens multiple instances of the page in one browser, and is not
-	 * unique to custom clients or malicious users. Some effort must be
-	 * taken to ensure that each user may only have one connection at a
-	 * time.
+	 * may be simply associated with the session and userID. If this user
+	 * already has a connection registered in userConns, handleConn takes
+	 * it over: the new connection replaces the old one in userConns, and
+	 * the old connection is then sent "T :Taken over" and closed from a
+	 * separate goroutine. The old connection is therefore not yet closed
+	 * at the moment the new one is installed as primary.
 	 */
 	err = handleConn(
 		req.Context(),
@@ -201,13 +199,43 @@ type errbytesT struct {
 	bytes *[]byte
 }
 
+/*
+ * statusTakenOver is a custom WebSocket close status used when a
+ * connection is displaced by a newer connection authenticated as the
+ * same user. It is in the range reserved for private use by RFC 6455
+ * section 7.4.2.
+ */
+const statusTakenOver websocket.StatusCode = 4001
+
+type connEntryT struct {
+	send *chan string
+	conn *websocket.Conn
+}
+
 var (
-	chanPool map[string](*chan string)
+	/*
+	 * chanPool holds the send channel and underlying connection for every
+	 * live session, keyed by session. The conn is kept alongside the
+	 * channel so that a connection which can't keep up with broadcasts
+	 * can be closed directly instead of merely dropping the message.
+	 */
+	chanPool map[string](*connEntryT)
 	/*
 	 * Normal Go maps are not thread safe, so we protect large chanPool
 	 * operations such as addition and deletion under a RWMutex.
 	 */
 	chanPoolLock sync.RWMutex
+
+	/*
+	 * userConns tracks the single connection currently considered
+	 * primary for each userID, so that a second connection from the
+	 * same user can take over instead of silently racing with the
+	 * first. It is protected by chanPoolLock alongside chanPool so
+	 * that inserting the new connection and evicting the old one
+	 * happen under a single lock acquisition. For a given connection,
+	 * the *connEntryT stored here is the same pointer as in chanPool.
+	 */
+	userConns map[string](*connEntryT)
 )
 
 func setupChanPool() error {
@@ -221,15 +249,72 @@ func setupChanPool() error {
 		return fmt.Errorf("cannot set up chanPool: %w", errUnexpectedRace)
 	}
 	defer chanPoolLock.Unlock()
-	chanPool = make(map[string](*chan string))
+	chanPool = make(map[string](*connEntryT))
+	userConns = make(map[string](*connEntryT))
 	return nil
 }
 
+/*
+ * eventT is a single course-selection-count change, as recorded in
+ * eventRing so that reconnecting clients can catch up on what they
+ * missed instead of re-fetching a full snapshot.
+ */
+type eventT struct {
+	Seq      uint64
+	CourseID int
+	Selected int
+}
+
+var (
+	/*
+	 * eventSeq and eventRing are protected by eventsLock, which is
+	 * deliberately kept separate from coursesLock: recordEvent is called
+	 * synchronously from within a course.SelectedLock critical section
+	 * (see recordEvent's doc comment below), and buildSnapshot and
+	 * reconcileSelectedLoop acquire a course's SelectedLock while holding
+	 * coursesLock. Reusing coursesLock here would make
+	 * recordEvent acquire coursesLock *after* a SelectedLock, the reverse
+	 * of that order, which is a lock-order inversion and can deadlock.
+	 * eventRing holds only the most recent config.Perf.EventRingSize
+	 * events, oldest first.
+	 */
+	eventsLock sync.Mutex
+	eventSeq   uint64
+	eventRing  []eventT
+)
+
+/*
+ * recordEvent assigns the next sequence number to a course-selection-count
+ * change and records it in eventRing. Callers must invoke this synchronously,
+ * from within the same course.SelectedLock critical section that mutates
+ * course.Selected, so that the order in which events are assigned sequence
+ * numbers matches the order in which the underlying Selected mutations are
+ * actually serialized; only the subsequent chanPool fan-out (broadcastEvent)
+ * is safe to hand off to a goroutine. recordEvent only ever takes
+ * eventsLock, never coursesLock, so it cannot invert lock order against
+ * code that takes coursesLock before a course's SelectedLock.
+ */
+func recordEvent(courseID int, selected int) uint64 {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	eventSeq++
+	eventRing = append(eventRing, eventT{Seq: eventSeq, CourseID: courseID, Selected: selected})
+	if len(eventRing) > config.Perf.EventRingSize {
+		eventRing = eventRing[len(eventRing)-config.Perf.EventRingSize:]
+	}
+	return eventSeq
+}
+
 /*
  * Only call this when it is okay for propagation to fail, such as in course
- * number updates. Failures are currently ignored.
+ * number updates. Failures are not reported to the caller; a connection
+ * whose SendQ is full is closed instead of being sent the message. seq must already have been
+ * obtained from recordEvent; this is the part that is safe to run
+ * concurrently with other broadcasts.
  */
-func propagateIgnoreFailures(msg string) {
+func broadcastEvent(seq uint64, courseID int, selected int) {
+	msg := fmt.Sprintf("N %d %d %d", seq, courseID, selected)
+
 	/*
 	 * It is not a mistake that we acquire a read lock instead of a write
 	 * lock here. Channels provide synchronization, and other than using
@@ -243,15 +328,74 @@ func propagateIgnoreFailures(msg string) {
 	defer chanPoolLock.RUnlock()
 	for k, v := range chanPool {
 		select {
-		case *v <- msg:
+		case *v.send <- msg:
 		default:
-			log.Println("WARNING: SendQ exceeded for " + k)
-			/* TODO: Perhaps it should be retried sometime */
+			/*
+			 * A client that can't keep up with N updates is not
+			 * usefully subscribed anymore, so close it rather than
+			 * silently dropping the message; it should reconnect and
+			 * catch up via the resumable HELLO handshake.
+			 */
+			log.Println("WARNING: SendQ exceeded for " + k + ", closing connection")
+			go func(conn *websocket.Conn) {
+				_ = conn.Close(websocket.StatusPolicyViolation, "SendQ exceeded; reconnect for a fresh snapshot")
+			}(v.conn)
 		}
 	}
 	/* TODO: Any possible errors? */
 }
 
+/*
+ * buildSnapshot assembles a START/END-framed snapshot of every course's
+ * current Selected count plus userID's existing choices, for clients
+ * that cannot be brought up to date by replaying eventRing alone. The
+ * returned lines already include the trailing END <seq> line; seq is
+ * also returned on its own for callers that want the snapshot's
+ * watermark without re-parsing the last line.
+ */
+func buildSnapshot(ctx context.Context, userID string) ([]string, uint64, error) {
+	lines := make([]string, 0, len(courses)+2)
+	lines = append(lines, "START")
+
+	seq := func() uint64 {
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		return eventSeq
+	}()
+
+	func() {
+		coursesLock.RLock()
+		defer coursesLock.RUnlock()
+		for _, course := range courses {
+			func() {
+				course.SelectedLock.RLock()
+				defer course.SelectedLock.RUnlock()
+				lines = append(lines, fmt.Sprintf("C %d %d", course.ID, course.Selected))
+			}()
+		}
+	}()
+
+	rows, err := db.Query(ctx, "SELECT courseid FROM choices WHERE userid = $1", userID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching user choices: %w", err)
+	}
+	for rows.Next() {
+		var courseID int
+		err := rows.Scan(&courseID)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning user choice: %w", err)
+		}
+		lines = append(lines, fmt.Sprintf("S %d", courseID))
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching user choices: %w", err)
+	}
+
+	lines = append(lines, "END "+strconv.FormatUint(seq, 10))
+	return lines, seq, nil
+}
+
 /*
  * The actual logic in handling the connection, after authentication has been
  * completed.
@@ -262,20 +406,35 @@ func handleConn(
 	session string,
 	userID string,
 ) error {
-	/*
-	 * TODO: Check for potential race conditions in chanPool handling
-	 */
 	send := make(chan string, config.Perf.SendQ)
+	entry := &connEntryT{send: &send, conn: c}
 	chanPoolLock.Lock()
 	func() {
 		defer chanPoolLock.Unlock()
-		chanPool[session] = &send
+		chanPool[session] = entry
+		/*
+		 * Installing the new registry entry and evicting the old one
+		 * happen under this single lock acquisition, so that there is
+		 * never a window in which both connections believe they are
+		 * primary for userID.
+		 */
+		old, exists := userConns[userID]
+		userConns[userID] = entry
 		log.Printf("Channel %v added to pool for session %s, userID %s\n", &send, session, userID)
+		if exists {
+			go func() {
+				_ = writeText(context.Background(), old.conn, "T :Taken over")
+				_ = old.conn.Close(statusTakenOver, "Taken over")
+			}()
+		}
 	}()
 	defer func() {
 		chanPoolLock.Lock()
 		defer chanPoolLock.Unlock()
 		delete(chanPool, session)
+		if userConns[userID] == entry {
+			delete(userConns, userID)
+		}
 		log.Printf("Purging channel %v for session %s userID %s, from pool\n", &send, session, userID)
 	}()
 
@@ -298,6 +457,17 @@ func handleConn(
 		}
 	}()
 
+	/*
+	 * lastFrame tracks the last time a client message arrived through
+	 * c.Read (pong replies to our pings do not update it), so that the
+	 * ping ticker below can detect and close idle
+	 * connections instead of leaving dead TCP connections in chanPool
+	 * forever.
+	 */
+	lastFrame := time.Now()
+	pingTicker := time.NewTicker(config.Perf.PingInterval)
+	defer pingTicker.Stop()
+
 	for {
 		var mar []string
 		select {
@@ -307,17 +477,93 @@ func handleConn(
 				return fmt.Errorf("error sending to websocket from send channel: %w", err)
 			}
 			continue
+		case <-pingTicker.C:
+			if time.Since(lastFrame) > config.Perf.IdleTimeout {
+				_ = c.Close(websocket.StatusPolicyViolation, "Idle timeout")
+				return fmt.Errorf("connection idle for longer than %v", config.Perf.IdleTimeout)
+			}
+			err := func() error {
+				/*
+				 * ctx itself is never cancelled just because the peer
+				 * has gone silent, so an unresponsive pong would block
+				 * c.Ping forever and park this entire select loop,
+				 * defeating the idle-timeout check above. Bound it to
+				 * its own timeout instead.
+				 */
+				pingCtx, cancel := context.WithTimeout(ctx, config.Perf.PingTimeout)
+				defer cancel()
+				return c.Ping(pingCtx)
+			}()
+			if err != nil {
+				_ = c.Close(websocket.StatusPolicyViolation, "Ping failed")
+				return fmt.Errorf("error pinging websocket: %w", err)
+			}
+			continue
 		case errbytes := <-recv:
 			if errbytes.err != nil {
 				return errbytes.err
 			}
+			lastFrame = time.Now()
 			mar = splitMsg(errbytes.bytes)
 			switch mar[0] {
 			case "HELLO":
+				if len(mar) > 2 {
+					return protocolError(ctx, c, "Invalid number of arguments for HELLO")
+				}
+				var lastSeq uint64
+				haveLastSeq := false
+				if len(mar) == 2 {
+					_lastSeq, err := strconv.ParseUint(mar[1], 10, 64)
+					if err != nil {
+						return protocolError(ctx, c, "HELLO sequence number must be an unsigned integer")
+					}
+					lastSeq = _lastSeq
+					haveLastSeq = true
+				}
+
 				err := writeText(ctx, c, "HI")
 				if err != nil {
 					return fmt.Errorf("error replying to HELLO: %w", err)
 				}
+
+				missed, needSnapshot := func() ([]eventT, bool) {
+					eventsLock.Lock()
+					defer eventsLock.Unlock()
+					earliestBuffered := eventSeq + 1
+					if len(eventRing) > 0 {
+						earliestBuffered = eventRing[0].Seq
+					}
+					if !haveLastSeq || lastSeq < earliestBuffered-1 {
+						return nil, true
+					}
+					missed := make([]eventT, 0, len(eventRing))
+					for _, ev := range eventRing {
+						if ev.Seq > lastSeq {
+							missed = append(missed, ev)
+						}
+					}
+					return missed, false
+				}()
+
+				if needSnapshot {
+					lines, _, err := buildSnapshot(ctx, userID)
+					if err != nil {
+						return protocolError(ctx, c, "Database error while building snapshot")
+					}
+					for _, line := range lines {
+						err := writeText(ctx, c, line)
+						if err != nil {
+							return fmt.Errorf("error sending snapshot: %w", err)
+						}
+					}
+				} else {
+					for _, ev := range missed {
+						err := writeText(ctx, c, fmt.Sprintf("N %d %d %d", ev.Seq, ev.CourseID, ev.Selected))
+						if err != nil {
+							return fmt.Errorf("error replaying missed event: %w", err)
+						}
+					}
+				}
 			case "Y":
 				if len(mar) != 2 {
 					return protocolError(ctx, c, "Invalid number of arguments for Y")
@@ -332,6 +578,13 @@ func handleConn(
 					defer coursesLock.RUnlock()
 					return courses[courseID]
 				}()
+				if course == nil {
+					err := writeText(ctx, c, "E "+mar[1]+" :UnknownCourse")
+					if err != nil {
+						return fmt.Errorf("error rejecting unknown course choice: %w", err)
+					}
+					continue
+				}
 
 				err = func() (returnedError error) { /* Named returns so I could modify them in defer */
 					tx, err := db.Begin(ctx)
@@ -346,6 +599,60 @@ func handleConn(
 						}
 					}()
 
+					if maxPerType, limited := config.MaxPerType[course.Type]; limited {
+						/*
+						 * Without serializing here, two concurrent Y
+						 * requests from the same user for different
+						 * courses of the same Type could both read
+						 * typeCount below maxPerType before either
+						 * commits, oversubscribing past the quota. The
+						 * advisory lock is scoped to the transaction
+						 * and keyed on userID+Type, so it's released
+						 * automatically on commit or rollback and
+						 * doesn't serialize unrelated types.
+						 */
+						_, err := tx.Exec(
+							ctx,
+							"SELECT pg_advisory_xact_lock(hashtext($1))",
+							userID+":"+string(course.Type),
+						)
+						if err != nil {
+							return protocolError(ctx, c, "Database error while acquiring category quota lock")
+						}
+
+						/*
+						 * Excludes courseID itself: otherwise a user
+						 * already sitting at their quota who re-sends Y
+						 * for the course they already hold would get
+						 * R :TypeLimit instead of the idempotent Y
+						 * reaffirm that duplicate selections otherwise
+						 * get.
+						 */
+						var typeCount int
+						err = tx.QueryRow(
+							ctx,
+							"SELECT COUNT(*) FROM choices JOIN courses ON choices.courseid = courses.id "+
+								"WHERE choices.userid = $1 AND courses.ctype = $2 AND choices.courseid != $3",
+							userID,
+							course.Type,
+							courseID,
+						).Scan(&typeCount)
+						if err != nil {
+							return protocolError(ctx, c, "Database error while checking category quota")
+						}
+						if typeCount >= maxPerType {
+							err := tx.Rollback(ctx)
+							if err != nil {
+								return protocolError(ctx, c, "Database error while rolling back transaction due to category quota")
+							}
+							err = writeText(ctx, c, "R "+mar[1]+" :TypeLimit")
+							if err != nil {
+								return fmt.Errorf("error rejecting course choice due to category quota: %w", err)
+							}
+							return nil
+						}
+					}
+
 					_, err = tx.Exec(
 						ctx, /* TODO: Do we really want this to be in a request context? */
 						"INSERT INTO choices (seltime, userid, courseid) VALUES ($1, $2, $3)",
@@ -370,7 +677,8 @@ func handleConn(
 						defer course.SelectedLock.Unlock()
 						if course.Selected < course.Max {
 							course.Selected++
-							go propagateIgnoreFailures(fmt.Sprintf("N %d %d", courseID, course.Selected))
+							seq := recordEvent(courseID, course.Selected)
+							go broadcastEvent(seq, courseID, course.Selected)
 							return true
 						}
 						return false
@@ -383,7 +691,8 @@ func handleConn(
 								course.SelectedLock.Lock()
 								defer course.SelectedLock.Unlock()
 								course.Selected--
-								propagateIgnoreFailures(fmt.Sprintf("N %d %d", courseID, course.Selected))
+								seq := recordEvent(courseID, course.Selected)
+								broadcastEvent(seq, courseID, course.Selected)
 							}()
 							return protocolError(ctx, c, "Database error while committing transaction")
 						}
@@ -410,6 +719,87 @@ func handleConn(
 				if len(mar) != 2 {
 					return protocolError(ctx, c, "Invalid number of arguments for N")
 				}
+				_courseID, err := strconv.ParseInt(mar[1], 10, strconv.IntSize)
+				if err != nil {
+					return protocolError(ctx, c, "Course ID must be an integer")
+				}
+				courseID := int(_courseID)
+				course := func() *courseT {
+					coursesLock.RLock()
+					defer coursesLock.RUnlock()
+					return courses[courseID]
+				}()
+				if course == nil {
+					err := writeText(ctx, c, "E "+mar[1]+" :UnknownCourse")
+					if err != nil {
+						return fmt.Errorf("error rejecting unknown course deselection: %w", err)
+					}
+					continue
+				}
+
+				err = func() (returnedError error) { /* Named returns so I could modify them in defer */
+					tx, err := db.Begin(ctx)
+					if err != nil {
+						return protocolError(ctx, c, "Database error while beginning transaction")
+					}
+					defer func() {
+						err := tx.Rollback(ctx)
+						if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+							returnedError = protocolError(ctx, c, "Database error while rolling back transaction in defer block")
+							return
+						}
+					}()
+
+					tag, err := tx.Exec(
+						ctx,
+						"DELETE FROM choices WHERE userid = $1 AND courseid = $2",
+						userID,
+						courseID,
+					)
+					if err != nil {
+						return protocolError(ctx, c, "Database error while deleting course choice")
+					}
+
+					if tag.RowsAffected() == 0 {
+						err := tx.Rollback(ctx)
+						if err != nil {
+							return protocolError(ctx, c, "Database error while rolling back transaction due to missing choice")
+						}
+						err = writeText(ctx, c, "E "+mar[1]+" :NotSelected")
+						if err != nil {
+							return fmt.Errorf("error rejecting course deselection: %w", err)
+						}
+						return nil
+					}
+
+					func() {
+						course.SelectedLock.Lock()
+						defer course.SelectedLock.Unlock()
+						course.Selected--
+						seq := recordEvent(courseID, course.Selected)
+						go broadcastEvent(seq, courseID, course.Selected)
+					}()
+
+					err = tx.Commit(ctx)
+					if err != nil {
+						go func() { /* Separate goroutine because we don't need a response from this operation */
+							course.SelectedLock.Lock()
+							defer course.SelectedLock.Unlock()
+							course.Selected++
+							seq := recordEvent(courseID, course.Selected)
+							broadcastEvent(seq, courseID, course.Selected)
+						}()
+						return protocolError(ctx, c, "Database error while committing transaction")
+					}
+					err = writeText(ctx, c, "N "+mar[1])
+					if err != nil {
+						return fmt.Errorf("error affirming course deselection: %w", err)
+					}
+					return nil
+				}()
+				if err != nil {
+					return err
+				}
 			default:
 				return protocolError(ctx, c, "Unknown command "+mar[0])
 			}